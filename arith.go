@@ -0,0 +1,598 @@
+package env
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Arith is bash-style arithmetic expansion, "$((expr))". Unlike
+// bash, which aborts the whole command on "division by zero",
+// evaluation here never fails: "/" and "%" by zero deliberately
+// evaluate to 0, so that expand (which has no way to report a
+// mid-expansion evaluation failure) always produces a result.
+type Arith struct {
+	expr arithNode
+
+	span Span
+}
+
+func (a Arith) Pos() Span { return a.span }
+func (Arith) node()       {}
+
+func (a Arith) expand(e Environment) string {
+	return strconv.FormatInt(a.expr.eval(e), 10)
+}
+
+// findArithEnd finds the end of a "$((...))" expression, given the
+// offset of the first character after "$((". It returns the offset
+// of the closing "))" (i.e. the end of the expression text) and the
+// offset just past it, tracking parenthesis depth so that
+// expressions like "$((1+(2*3)))" close at the right place.
+func findArithEnd(s string, start int) (int, int, bool) {
+	depth := 0
+	for p := start; p < len(s); p++ {
+		switch s[p] {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				if p+1 < len(s) && s[p+1] == ')' {
+					return p, p + 2, true
+				}
+				return -1, -1, false
+			}
+			depth--
+		}
+	}
+	return -1, -1, false
+}
+
+// parseArith parses a "$((...))" arithmetic expansion, starting at
+// the '$' of "$((". It is reached from parseExpansion, and follows
+// the same (expansion, error) contract as the other make* helpers.
+func parseArith(s string, o int) (expansion, error) {
+	start := o + 3
+
+	exprEnd, tokenEnd, ok := findArithEnd(s, start)
+	if !ok {
+		return Literal{Value: "failed"}, parseErr(s, o, "in arithmetic expansion", fmt.Errorf("unterminated $(( expression"))
+	}
+
+	exprText := s[start:exprEnd]
+
+	// The lexer and parser report offsets into exprText; make those
+	// errors refer to s, like every other ParseError from here.
+	toInput := func(err error) error {
+		if pe, ok := err.(*ParseError); ok {
+			pe.Input = s
+			pe.Offset += start
+		}
+		return err
+	}
+
+	toks, err := lexArith(exprText)
+	if err != nil {
+		return Literal{Value: "failed"}, parseErr(s, start, "in arithmetic expansion", toInput(err))
+	}
+
+	p := &arithParser{toks: toks, src: exprText}
+	node, err := p.parseAssignment()
+	if err != nil {
+		return Literal{Value: "failed"}, parseErr(s, start, "in arithmetic expansion", toInput(err))
+	}
+	if p.peek().kind != arithEOF {
+		return Literal{Value: "failed"}, parseErr(s, start+p.peek().pos, "in arithmetic expansion", fmt.Errorf("unexpected trailing input %q", p.peek().text))
+	}
+
+	return Arith{expr: node, span: Span{o, tokenEnd}}, nil
+}
+
+// arithNode is implemented by every node of a parsed arithmetic
+// expression.
+type arithNode interface {
+	eval(e Environment) int64
+}
+
+type arithLit int64
+
+func (n arithLit) eval(e Environment) int64 { return int64(n) }
+
+// arithIdentNode resolves a bare identifier through the
+// Environment, parsing it as 0 when it is unset or not a valid
+// integer, matching bash's arithmetic evaluation rules.
+type arithIdentNode string
+
+func (n arithIdentNode) eval(e Environment) int64 {
+	v, ok := e.Get(string(n))
+	if !ok {
+		return 0
+	}
+	i, err := strconv.ParseInt(strings.TrimSpace(v), 0, 64)
+	if err != nil {
+		return 0
+	}
+	return i
+}
+
+type arithUnary struct {
+	op byte
+	x  arithNode
+}
+
+func (n arithUnary) eval(e Environment) int64 {
+	v := n.x.eval(e)
+	switch n.op {
+	case '-':
+		return -v
+	case '!':
+		return boolToInt64(v == 0)
+	case '~':
+		return ^v
+	}
+	return v
+}
+
+type arithBinary struct {
+	op   string
+	l, r arithNode
+}
+
+func boolToInt64(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ipow implements the "**" operator: integer exponentiation by
+// squaring, with negative exponents (which bash rejects at runtime)
+// simply yielding 0.
+func ipow(base, exp int64) int64 {
+	if exp < 0 {
+		return 0
+	}
+	var result int64 = 1
+	for exp > 0 {
+		if exp&1 == 1 {
+			result *= base
+		}
+		base *= base
+		exp >>= 1
+	}
+	return result
+}
+
+func (n arithBinary) eval(e Environment) int64 {
+	switch n.op {
+	case "&&":
+		if n.l.eval(e) == 0 {
+			return 0
+		}
+		return boolToInt64(n.r.eval(e) != 0)
+	case "||":
+		if n.l.eval(e) != 0 {
+			return 1
+		}
+		return boolToInt64(n.r.eval(e) != 0)
+	}
+
+	l := n.l.eval(e)
+	r := n.r.eval(e)
+
+	switch n.op {
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	case "/":
+		// Bash treats "x/0" as a fatal error; we have no channel to
+		// report one mid-evaluation, so we deliberately yield 0
+		// instead (see the Arith doc comment).
+		if r == 0 {
+			return 0
+		}
+		return l / r
+	case "%":
+		if r == 0 {
+			return 0
+		}
+		return l % r
+	case "**":
+		return ipow(l, r)
+	case "&":
+		return l & r
+	case "|":
+		return l | r
+	case "^":
+		return l ^ r
+	case "<<":
+		return l << uint(r)
+	case ">>":
+		return l >> uint(r)
+	case "<":
+		return boolToInt64(l < r)
+	case "<=":
+		return boolToInt64(l <= r)
+	case ">":
+		return boolToInt64(l > r)
+	case ">=":
+		return boolToInt64(l >= r)
+	case "==":
+		return boolToInt64(l == r)
+	case "!=":
+		return boolToInt64(l != r)
+	}
+
+	return 0
+}
+
+type arithTernary struct {
+	cond, then, els arithNode
+}
+
+func (n arithTernary) eval(e Environment) int64 {
+	if n.cond.eval(e) != 0 {
+		return n.then.eval(e)
+	}
+	return n.els.eval(e)
+}
+
+// arithAssign implements "id = expr" and the "+=", "-=", "*=", "/="
+// and "%=" compound forms. The result is stored back into e as a
+// decimal string.
+type arithAssign struct {
+	name string
+	op   string
+	val  arithNode
+}
+
+func (n arithAssign) eval(e Environment) int64 {
+	v := n.val.eval(e)
+
+	if n.op != "=" {
+		cur := arithIdentNode(n.name).eval(e)
+		switch n.op {
+		case "+=":
+			v = cur + v
+		case "-=":
+			v = cur - v
+		case "*=":
+			v = cur * v
+		case "/=":
+			if v != 0 {
+				v = cur / v
+			} else {
+				v = 0
+			}
+		case "%=":
+			if v != 0 {
+				v = cur % v
+			} else {
+				v = 0
+			}
+		}
+	}
+
+	e.Set(n.name, strconv.FormatInt(v, 10))
+	return v
+}
+
+type arithTokKind int
+
+const (
+	arithEOF arithTokKind = iota
+	arithNum
+	arithIdent
+	arithOp
+	arithLParen
+	arithRParen
+	arithQuestion
+	arithColon
+)
+
+type arithTok struct {
+	kind arithTokKind
+	text string
+	pos  int
+	num  int64
+}
+
+func isHexByte(c byte) bool {
+	switch {
+	case c >= '0' && c <= '9':
+		return true
+	case c >= 'a' && c <= 'f':
+		return true
+	case c >= 'A' && c <= 'F':
+		return true
+	}
+	return false
+}
+
+func arithIdentStart(c byte) bool {
+	return nameConstituent(c) && !(c >= '0' && c <= '9')
+}
+
+// lexArith tokenizes the text of a "$((...))" expression (with the
+// "$((" and "))" already stripped off).
+func lexArith(s string) ([]arithTok, error) {
+	var toks []arithTok
+	i := 0
+	n := len(s)
+
+	twoCharOps := map[string]bool{
+		"<<": true, ">>": true, "<=": true, ">=": true, "==": true, "!=": true,
+		"&&": true, "||": true, "+=": true, "-=": true, "*=": true, "/=": true,
+		"%=": true, "**": true,
+	}
+
+	for i < n {
+		c := s[i]
+
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(':
+			toks = append(toks, arithTok{kind: arithLParen, pos: i})
+			i++
+		case c == ')':
+			toks = append(toks, arithTok{kind: arithRParen, pos: i})
+			i++
+		case c == '?':
+			toks = append(toks, arithTok{kind: arithQuestion, pos: i})
+			i++
+		case c == ':':
+			toks = append(toks, arithTok{kind: arithColon, pos: i})
+			i++
+		case c >= '0' && c <= '9':
+			start := i
+			for i < n && (isHexByte(s[i]) || s[i] == 'x' || s[i] == 'X') {
+				i++
+			}
+			v, err := strconv.ParseInt(s[start:i], 0, 64)
+			if err != nil {
+				return nil, parseErr(s, start, "in arithmetic literal", err)
+			}
+			toks = append(toks, arithTok{kind: arithNum, pos: start, num: v})
+		case arithIdentStart(c):
+			start := i
+			for i < n && nameConstituent(s[i]) {
+				i++
+			}
+			toks = append(toks, arithTok{kind: arithIdent, text: s[start:i], pos: start})
+		default:
+			if i+2 <= n && twoCharOps[s[i:i+2]] {
+				toks = append(toks, arithTok{kind: arithOp, text: s[i : i+2], pos: i})
+				i += 2
+				continue
+			}
+			switch c {
+			case '+', '-', '*', '/', '%', '&', '|', '^', '~', '!', '<', '>', '=':
+				toks = append(toks, arithTok{kind: arithOp, text: string(c), pos: i})
+				i++
+			default:
+				return nil, parseErr(s, i, "in arithmetic expression", fmt.Errorf("unexpected character %q", c))
+			}
+		}
+	}
+
+	toks = append(toks, arithTok{kind: arithEOF, pos: n})
+	return toks, nil
+}
+
+// arithParser is a precedence-climbing parser over the tokens
+// produced by lexArith.
+type arithParser struct {
+	toks []arithTok
+	pos  int
+	src  string
+}
+
+func (p *arithParser) peek() arithTok {
+	return p.toks[p.pos]
+}
+
+func (p *arithParser) next() arithTok {
+	t := p.toks[p.pos]
+	if p.pos+1 < len(p.toks) {
+		p.pos++
+	}
+	return t
+}
+
+func (p *arithParser) expect(kind arithTokKind, what string) (arithTok, error) {
+	t := p.peek()
+	if t.kind != kind {
+		return t, parseErr(p.src, t.pos, "in arithmetic expression", fmt.Errorf("expected %s", what))
+	}
+	return p.next(), nil
+}
+
+// parseAssignment is the entry point: "id = expr" and its compound
+// forms, falling through to the ternary operator for everything
+// else.
+func (p *arithParser) parseAssignment() (arithNode, error) {
+	if p.peek().kind == arithIdent {
+		save := p.pos
+		name := p.next().text
+
+		if p.peek().kind == arithOp {
+			switch p.peek().text {
+			case "=", "+=", "-=", "*=", "/=", "%=":
+				op := p.next().text
+				val, err := p.parseAssignment()
+				if err != nil {
+					return nil, err
+				}
+				return arithAssign{name: name, op: op, val: val}, nil
+			}
+		}
+
+		p.pos = save
+	}
+
+	return p.parseTernary()
+}
+
+func (p *arithParser) parseTernary() (arithNode, error) {
+	cond, err := p.parseLogicalOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind != arithQuestion {
+		return cond, nil
+	}
+	p.next()
+
+	then, err := p.parseAssignment()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(arithColon, `":"`); err != nil {
+		return nil, err
+	}
+	els, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+
+	return arithTernary{cond: cond, then: then, els: els}, nil
+}
+
+// parseBinaryLevel implements one precedence level of left-to-right
+// binary operators, shared by every level from "||" down to "*".
+func (p *arithParser) parseBinaryLevel(ops map[string]bool, next func() (arithNode, error)) (arithNode, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == arithOp && ops[p.peek().text] {
+		op := p.next().text
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = arithBinary{op: op, l: left, r: right}
+	}
+
+	return left, nil
+}
+
+var (
+	logicalOrOps  = map[string]bool{"||": true}
+	logicalAndOps = map[string]bool{"&&": true}
+	bitOrOps      = map[string]bool{"|": true}
+	bitXorOps     = map[string]bool{"^": true}
+	bitAndOps     = map[string]bool{"&": true}
+	equalityOps   = map[string]bool{"==": true, "!=": true}
+	relationalOps = map[string]bool{"<": true, "<=": true, ">": true, ">=": true}
+	shiftOps      = map[string]bool{"<<": true, ">>": true}
+	additiveOps   = map[string]bool{"+": true, "-": true}
+	multOps       = map[string]bool{"*": true, "/": true, "%": true}
+)
+
+func (p *arithParser) parseLogicalOr() (arithNode, error) {
+	return p.parseBinaryLevel(logicalOrOps, p.parseLogicalAnd)
+}
+
+func (p *arithParser) parseLogicalAnd() (arithNode, error) {
+	return p.parseBinaryLevel(logicalAndOps, p.parseBitOr)
+}
+
+func (p *arithParser) parseBitOr() (arithNode, error) {
+	return p.parseBinaryLevel(bitOrOps, p.parseBitXor)
+}
+
+func (p *arithParser) parseBitXor() (arithNode, error) {
+	return p.parseBinaryLevel(bitXorOps, p.parseBitAnd)
+}
+
+func (p *arithParser) parseBitAnd() (arithNode, error) {
+	return p.parseBinaryLevel(bitAndOps, p.parseEquality)
+}
+
+func (p *arithParser) parseEquality() (arithNode, error) {
+	return p.parseBinaryLevel(equalityOps, p.parseRelational)
+}
+
+func (p *arithParser) parseRelational() (arithNode, error) {
+	return p.parseBinaryLevel(relationalOps, p.parseShift)
+}
+
+func (p *arithParser) parseShift() (arithNode, error) {
+	return p.parseBinaryLevel(shiftOps, p.parseAdditive)
+}
+
+func (p *arithParser) parseAdditive() (arithNode, error) {
+	return p.parseBinaryLevel(additiveOps, p.parseMultiplicative)
+}
+
+func (p *arithParser) parseMultiplicative() (arithNode, error) {
+	return p.parseBinaryLevel(multOps, p.parsePower)
+}
+
+// parsePower handles "**", which is right-associative.
+func (p *arithParser) parsePower() (arithNode, error) {
+	base, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind == arithOp && p.peek().text == "**" {
+		p.next()
+		exp, err := p.parsePower()
+		if err != nil {
+			return nil, err
+		}
+		return arithBinary{op: "**", l: base, r: exp}, nil
+	}
+
+	return base, nil
+}
+
+func (p *arithParser) parseUnary() (arithNode, error) {
+	t := p.peek()
+	if t.kind == arithOp && (t.text == "+" || t.text == "-" || t.text == "!" || t.text == "~") {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if t.text == "+" {
+			return x, nil
+		}
+		return arithUnary{op: t.text[0], x: x}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *arithParser) parsePrimary() (arithNode, error) {
+	t := p.peek()
+
+	switch t.kind {
+	case arithNum:
+		p.next()
+		return arithLit(t.num), nil
+	case arithIdent:
+		p.next()
+		return arithIdentNode(t.text), nil
+	case arithLParen:
+		p.next()
+		x, err := p.parseAssignment()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(arithRParen, `")"`); err != nil {
+			return nil, err
+		}
+		return x, nil
+	}
+
+	return nil, parseErr(p.src, t.pos, "in arithmetic expression", fmt.Errorf("unexpected token"))
+}
@@ -0,0 +1,119 @@
+package env
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestArithExpand(t *testing.T) {
+	e := internal{"a": "2", "b": "3", "s": "not a number"}
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"$((1+2))", "3"},
+		{"$((2*3+4))", "10"},
+		{"$((2+3*4))", "14"},
+		{"$((10/3))", "3"},
+		{"$((10%3))", "1"},
+		// Division/modulo by zero deliberately yield 0 here, unlike
+		// bash's fatal "division by zero" (see the Arith doc comment).
+		{"$((10/0))", "0"},
+		{"$((10%0))", "0"},
+		{"$((2**10))", "1024"},
+		{"$((2**3**2))", "512"},
+		{"$((-5))", "-5"},
+		{"$((+5))", "5"},
+		{"$((!0))", "1"},
+		{"$((!5))", "0"},
+		{"$((~0))", "-1"},
+		{"$((1 & 3))", "1"},
+		{"$((1 | 2))", "3"},
+		{"$((5 ^ 1))", "4"},
+		{"$((1 << 4))", "16"},
+		{"$((256 >> 4))", "16"},
+		{"$((1 < 2))", "1"},
+		{"$((2 < 1))", "0"},
+		{"$((2 <= 2))", "1"},
+		{"$((2 >= 3))", "0"},
+		{"$((2 == 2))", "1"},
+		{"$((2 != 2))", "0"},
+		{"$((1 && 0))", "0"},
+		{"$((1 && 1))", "1"},
+		{"$((0 || 0))", "0"},
+		{"$((0 || 1))", "1"},
+		{"$((1 ? 2 : 3))", "2"},
+		{"$((0 ? 2 : 3))", "3"},
+		{"$((a))", "2"},
+		{"$((a+b))", "5"},
+		{"$((s))", "0"},
+		{"$((missing))", "0"},
+		{"$((0x10))", "16"},
+		{"$((010))", "8"},
+		{"$(((1+2)*3))", "9"},
+	}
+
+	for ix, c := range cases {
+		seen, err := ExpandWithEnvironment(c.in, e)
+		if err != nil {
+			t.Errorf("Case %d, (%s), unexpected error, %s", ix, c.in, err)
+			continue
+		}
+		if seen != c.want {
+			t.Errorf("Case %d, (%s), saw «%s», wanted «%s»", ix, c.in, seen, c.want)
+		}
+	}
+}
+
+func TestArithAssign(t *testing.T) {
+	e := internal{"a": "2"}
+
+	cases := []struct {
+		in   string
+		want string
+		a    string
+	}{
+		{"$((a = 5))", "5", "5"},
+		{"$((a += 3))", "8", "8"},
+		{"$((a -= 1))", "7", "7"},
+		{"$((a *= 2))", "14", "14"},
+		{"$((a /= 7))", "2", "2"},
+		{"$((a %= 2))", "0", "0"},
+	}
+
+	for ix, c := range cases {
+		seen, err := ExpandWithEnvironment(c.in, e)
+		if err != nil {
+			t.Errorf("Case %d, (%s), unexpected error, %s", ix, c.in, err)
+			continue
+		}
+		if seen != c.want {
+			t.Errorf("Case %d, (%s), saw «%s», wanted «%s»", ix, c.in, seen, c.want)
+		}
+		if got, _ := e.Get("a"); got != c.a {
+			t.Errorf("Case %d, (%s), a=%q, wanted %q", ix, c.in, got, c.a)
+		}
+	}
+}
+
+func TestArithParseErrors(t *testing.T) {
+	cases := []string{
+		"$((1+))",
+		"$((1 2))",
+		"$((1+2",
+		"$((@))",
+	}
+
+	for ix, c := range cases {
+		_, err := ExpandWithEnvironment(c, internal{})
+		if err == nil {
+			t.Errorf("Case %d, (%s), expected an error, saw none", ix, c)
+			continue
+		}
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("Case %d, (%s), expected a *ParseError, saw %T", ix, c, err)
+		}
+	}
+}
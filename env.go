@@ -3,9 +3,13 @@
 package env
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -13,9 +17,15 @@ import (
 // An interface to allow us to more easily test this, as some of the
 // expansions are state-modifying. This way, we can ensure that we
 // have a known state for testing.
+//
+// Names was added to support "${!prefix*}"/"${!prefix@}" name
+// listing; this is a breaking change for any external implementer
+// of Environment, which must now add a Names method alongside Set
+// and Get.
 type Environment interface {
 	Set(name, value string)
 	Get(name string) (string, bool)
+	Names() []string
 }
 
 type native struct{}
@@ -30,6 +40,19 @@ func (e native) Get(name string) (string, bool) {
 	return os.LookupEnv(name)
 }
 
+// Names returns the names of all variables currently set in the
+// proper environment.
+func (e native) Names() []string {
+	vars := os.Environ()
+	names := make([]string, 0, len(vars))
+	for _, v := range vars {
+		if i := strings.IndexByte(v, '='); i >= 0 {
+			names = append(names, v[:i])
+		}
+	}
+	return names
+}
+
 type internal map[string]string
 
 func (i internal) Set(name, value string) {
@@ -41,6 +64,14 @@ func (i internal) Get(name string) (string, bool) {
 	return v, ok
 }
 
+func (i internal) Names() []string {
+	names := make([]string, 0, len(i))
+	for k := range i {
+		names = append(names, k)
+	}
+	return names
+}
+
 // Find the next "looks like the start of a variable expansion" in a
 // string, starting at a given offset. Return -1 to indicate "no next".
 func findNextStart(s string, p int) int {
@@ -117,6 +148,7 @@ func findNextEnd(s string, p int) int {
 	//  2: no { at the start, not a digit
 	//  3: a digit
 	state := 0
+	depth := 0
 
 	for p < end {
 		switch state {
@@ -126,6 +158,7 @@ func findNextEnd(s string, p int) int {
 				state = 0
 			case '{':
 				state = 1
+				depth = 1
 			case '0':
 				state = 3
 			case '1':
@@ -150,8 +183,14 @@ func findNextEnd(s string, p int) int {
 				state = 2
 			}
 		case 1:
-			if s[p] == '}' {
-				return p + 1
+			switch s[p] {
+			case '{':
+				depth++
+			case '}':
+				depth--
+				if depth == 0 {
+					return p + 1
+				}
 			}
 		case 2:
 			c := s[p]
@@ -167,48 +206,92 @@ func findNextEnd(s string, p int) int {
 	return end
 }
 
-// Gneeral interface for expansions. This simply has a single `expand`
-// method that returns the expansion given a specific environment.
+// Span is a half-open byte range [Start, End) into the source text
+// that was passed to Parse.
+type Span struct {
+	Start, End int
+}
+
+// Node is implemented by every element of a parsed Template. Pos
+// returns the span of source text the node was parsed from.
+type Node interface {
+	Pos() Span
+	node()
+}
+
+// expansion is implemented by every Node that contributes expanded
+// text to the result of a Template's Expand.
 type expansion interface {
+	Node
 	expand(Environment) string
 }
 
-type positional int
+// Positional holds a positional parameter, like "$1".
+type Positional struct {
+	Index int
+
+	span Span
+}
+
+func (p Positional) Pos() Span { return p.span }
+func (Positional) node()       {}
 
 // Positional parameters, note that these do NOT use the envionment,
 // but we pass it in to fulfill the interface contract.
-func (p positional) expand(e Environment) string {
-	if int(p) >= len(os.Args) {
+func (p Positional) expand(e Environment) string {
+	if p.Index >= len(os.Args) {
 		return ""
 	}
-	return os.Args[int(p)]
+	return os.Args[p.Index]
+}
+
+// Literal is a run of source text that is copied through unchanged.
+// It also stands in for the literal (non-nested) word operand of
+// other expansions, e.g. the "default" in "${foo:-default}".
+type Literal struct {
+	Value string
+
+	span Span
 }
 
-type constant string
+func (l Literal) Pos() Span { return l.span }
+func (Literal) node()       {}
 
 // These are constant strings, we simply need to provide a method for
 // them to be stored as expansions.
-func (c constant) expand(e Environment) string {
-	return string(c)
+func (l Literal) expand(e Environment) string {
+	return l.Value
 }
 
-type normal string
-
-// A normal variable expansion, like "$foo" or "${foo}".
-func (n normal) expand(e Environment) string {
-	v, _ := e.Get(string(n))
+// Normal is a plain variable expansion, like "$foo" or "${foo}".
+type Normal struct {
+	Name string
 
-	return v
+	span Span
 }
 
-type indirect struct {
-	name string
+func (n Normal) Pos() Span { return n.span }
+func (Normal) node()       {}
+
+func (n Normal) expand(e Environment) string {
+	v, _ := e.Get(n.Name)
+
+	return v
 }
 
 // Indirect expansion, "${!foo}", this first expands foo, then uses
 // that for a second "normal" expansion.
-func (i indirect) expand(e Environment) string {
-	next, ok := e.Get(i.name)
+type Indirect struct {
+	Name string
+
+	span Span
+}
+
+func (i Indirect) Pos() Span { return i.span }
+func (Indirect) node()       {}
+
+func (i Indirect) expand(e Environment) string {
+	next, ok := e.Get(i.Name)
 	if !ok {
 		return ""
 	}
@@ -217,147 +300,167 @@ func (i indirect) expand(e Environment) string {
 	return v
 }
 
-type defaulted struct {
-	name  string
-	word  expansion
-	unset bool
+// Defaulted expansion, like "${foo:-default}" or "$foo-default}"
+type Defaulted struct {
+	Name  string
+	Word  Node
+	Unset bool
+
+	span Span
 }
 
-// Defaulted expansion, like "${foo:-default}" or "$foo-default}"
-func (d defaulted) expand(e Environment) string {
-	v, ok := e.Get(d.name)
+func (d Defaulted) Pos() Span { return d.span }
+func (Defaulted) node()       {}
+
+func (d Defaulted) expand(e Environment) string {
+	v, ok := e.Get(d.Name)
 
 	if !ok {
-		return d.word.expand(e)
+		return d.Word.(expansion).expand(e)
 	}
 
-	if !d.unset {
+	if !d.Unset {
 		if v == "" {
-			return d.word.expand(e)
+			return d.Word.(expansion).expand(e)
 		}
 	}
 
 	return v
 }
 
-func makeDefaulted(s string, i int, name string, unsetOnly bool) (expansion, error) {
+func makeDefaulted(s string, i int, name string, unsetOnly bool, span Span) (expansion, error) {
 	var err error
 
-	rv := defaulted{name: name, unset: unsetOnly}
+	rv := Defaulted{Name: name, Unset: unsetOnly, span: span}
 
 	if s[i] == '$' {
-		rv.word, err = parseExpansion(s, i)
+		rv.Word, err = parseExpansion(s, i)
 		if err != nil {
-			return rv, err
+			return rv, parseErr(s, i, "in default word", err)
 		}
 	} else {
 		end := i
 		for s[end] != '}' {
 			end++
 		}
-		rv.word = constant(s[i:end])
+		rv.Word = Literal{Value: s[i:end], span: Span{i, end}}
 	}
 
 	return rv, nil
 }
 
-type assign struct {
-	name  string
-	word  expansion
-	unset bool
+// Assign expansion, like "${foo:=default}" or "${foo=default}"
+type Assign struct {
+	Name  string
+	Word  Node
+	Unset bool
+
+	span Span
 }
 
-// Assignment expansion, like "${foo:=default}" or "${foo=default}"
-func (a assign) expand(e Environment) string {
-	v, ok := e.Get(a.name)
+func (a Assign) Pos() Span { return a.span }
+func (Assign) node()       {}
+
+func (a Assign) expand(e Environment) string {
+	v, ok := e.Get(a.Name)
 	if !ok {
-		v = a.word.expand(e)
-		e.Set(a.name, v)
+		v = a.Word.(expansion).expand(e)
+		e.Set(a.Name, v)
 	}
 
 	return v
 }
 
-func makeAssigned(s string, i int, name string, unsetOnly bool) (expansion, error) {
+func makeAssigned(s string, i int, name string, unsetOnly bool, span Span) (expansion, error) {
 	var err error
 	end := findNextEnd(s, i)
-	rv := assign{name: name, unset: unsetOnly}
+	rv := Assign{Name: name, Unset: unsetOnly, span: span}
 	if s[i] == '$' {
 		end = findNextEnd(s, end+1)
-		rv.word, err = parseExpansion(s, i)
+		rv.Word, err = parseExpansion(s, i)
 		if err != nil {
-			return rv, err
+			return rv, parseErr(s, i, "in assign word", err)
 		}
 	} else {
-		rv.word = constant(s[i:end])
+		rv.Word = Literal{Value: s[i:end], span: Span{i, end}}
 	}
 
 	return rv, nil
 
 }
 
-type alternate struct {
-	name  string
-	word  expansion
-	unset bool
-}
-
 // Alternate expansion, this is "${foo:+alternate}" or
 // "${foo+alternate}", the alternate is substituted if foo has a
 // value, and is otherwise blank.
-func (a alternate) expand(e Environment) string {
-	v, ok := e.Get(a.name)
+type Alternate struct {
+	Name  string
+	Word  Node
+	Unset bool
+
+	span Span
+}
+
+func (a Alternate) Pos() Span { return a.span }
+func (Alternate) node()       {}
+
+func (a Alternate) expand(e Environment) string {
+	v, ok := e.Get(a.Name)
 
 	if !ok {
 		return ""
 	}
 
-	if v == "" && !a.unset {
+	if v == "" && !a.Unset {
 		return ""
 	}
 
-	return a.word.expand(e)
+	return a.Word.(expansion).expand(e)
 }
 
-func makeAlternated(s string, i int, name string, unsetOnly bool) (expansion, error) {
+func makeAlternated(s string, i int, name string, unsetOnly bool, span Span) (expansion, error) {
 	var err error
 
-	rv := alternate{name: name, unset: unsetOnly}
+	rv := Alternate{Name: name, Unset: unsetOnly, span: span}
 	end := findNextEnd(s, i)
 
 	if s[i] == '$' {
 		end = findNextEnd(s, end+1)
-		rv.word, err = parseExpansion(s, i)
+		rv.Word, err = parseExpansion(s, i)
 		if err != nil {
-			return rv, err
+			return rv, parseErr(s, i, "in alternate word", err)
 		}
 	} else {
-		rv.word = constant(s[i:end])
+		rv.Word = Literal{Value: s[i:end], span: Span{i, end}}
 	}
 
 	return rv, nil
 }
 
-type offset struct {
-	name   string
-	offset int
-	length int
-	useLen bool
-}
-
 // Offset expansion, this is "${foo:<offset>}" or
 // "${foo:<offset>:<length>}". There's some complicated "what happens
 // if there are negative numbers" behaviour, please cross-reference
 // the bash manual for specifics.
-func (o offset) expand(e Environment) string {
-	v, ok := e.Get(o.name)
+type Offset struct {
+	Name      string
+	Start     int
+	Length    int
+	HasLength bool
+
+	span Span
+}
+
+func (o Offset) Pos() Span { return o.span }
+func (Offset) node()       {}
+
+func (o Offset) expand(e Environment) string {
+	v, ok := e.Get(o.Name)
 	if !ok {
 		return ""
 	}
 
 	l := len(v)
 
-	b := o.offset
+	b := o.Start
 	if b < 0 {
 		b = l + b
 	}
@@ -366,11 +469,11 @@ func (o offset) expand(e Environment) string {
 	}
 
 	end := l
-	if o.useLen {
-		if o.length > 0 {
-			end = b + o.length
+	if o.HasLength {
+		if o.Length > 0 {
+			end = b + o.Length
 		} else {
-			end = l + o.length
+			end = l + o.Length
 		}
 	}
 	if end > l {
@@ -383,8 +486,8 @@ func (o offset) expand(e Environment) string {
 	return v[b:end]
 }
 
-func makeOffseted(s string, i int, name string) (expansion, error) {
-	rv := offset{name: name}
+func makeOffseted(s string, i int, name string, span Span) (expansion, error) {
+	rv := Offset{Name: name, span: span}
 
 	for s[i] == ':' {
 		i++
@@ -398,9 +501,9 @@ func makeOffseted(s string, i int, name string) (expansion, error) {
 	next := skipToNext(s, ":}", i)
 	n, err := strconv.Atoi(s[i:next])
 	if err != nil {
-		return rv, err
+		return rv, parseErr(s, i, "in offset spec", err)
 	}
-	rv.offset = n
+	rv.Start = n
 
 	if s[next] == ':' {
 		// We have a length
@@ -412,45 +515,59 @@ func makeOffseted(s string, i int, name string) (expansion, error) {
 		end := skipToNext(s, "}", i)
 		n, err := strconv.Atoi(s[i:end])
 		if err != nil {
-			return rv, err
+			return rv, parseErr(s, i, "in length spec", err)
 		}
-		rv.useLen = true
-		rv.length = n
+		rv.HasLength = true
+		rv.Length = n
 	}
 
 	return rv, nil
 }
 
-type length struct {
-	name string
+// Length expands to the length of a variable's value, "${#foo}".
+type Length struct {
+	Name string
+
+	span Span
 }
 
-func (l length) expand(e Environment) string {
-	value, _ := e.Get(l.name)
+func (l Length) Pos() Span { return l.span }
+func (Length) node()       {}
+
+func (l Length) expand(e Environment) string {
+	value, _ := e.Get(l.Name)
 	return fmt.Sprintf("%d", len(value))
 }
 
-type match struct {
-	name    string
-	pattern string
-	longest bool
-	suffix  bool
+// Match is a prefix or suffix glob match, shortest or longest, e.g.
+// "${foo#pattern}", "${foo##pattern}", "${foo%pattern}" or
+// "${foo%%pattern}".
+type Match struct {
+	Name    string
+	Pattern string
+	Longest bool
+	Suffix  bool
+
+	span Span
 }
 
+func (m Match) Pos() Span { return m.span }
+func (Match) node()       {}
+
 // Expand matches, we are using the same type for lonmgest/shortest
 // prefix/suffix match, as it's pretty much the same logic throughout.
-func (m match) expand(e Environment) string {
-	v, ok := e.Get(m.name)
+func (m Match) expand(e Environment) string {
+	v, ok := e.Get(m.Name)
 	if !ok {
 		return ""
 	}
 
 	l := len(v)
 
-	if m.suffix {
-		if m.longest {
+	if m.Suffix {
+		if m.Longest {
 			for o := 0; o < l; o++ {
-				matched, err := filepath.Match(m.pattern, v[o:])
+				matched, err := filepath.Match(m.Pattern, v[o:])
 				if err != nil {
 					return ""
 				}
@@ -460,7 +577,7 @@ func (m match) expand(e Environment) string {
 			}
 		} else {
 			for o := l; o >= 0; o-- {
-				matched, err := filepath.Match(m.pattern, v[o:])
+				matched, err := filepath.Match(m.Pattern, v[o:])
 				if err != nil {
 					return ""
 				}
@@ -470,9 +587,9 @@ func (m match) expand(e Environment) string {
 			}
 		}
 	} else {
-		if m.longest {
+		if m.Longest {
 			for o := l; o >= 0; o-- {
-				matched, err := filepath.Match(m.pattern, v[:o])
+				matched, err := filepath.Match(m.Pattern, v[:o])
 				if err != nil {
 					return ""
 				}
@@ -482,7 +599,7 @@ func (m match) expand(e Environment) string {
 			}
 		} else {
 			for o := 0; o < l; o++ {
-				matched, err := filepath.Match(m.pattern, v[:o])
+				matched, err := filepath.Match(m.Pattern, v[:o])
 				if err != nil {
 					return ""
 				}
@@ -525,124 +642,720 @@ func manglePattern(pattern string) string {
 	return acc.String()
 }
 
-func makeMatch(s string, i int, name string, suffix bool) expansion {
+func makeMatch(s string, i int, name string, suffix bool, span Span) expansion {
 	check := map[bool]byte{false: '#', true: '%'}
-	rv := match{name: name, suffix: suffix}
+	rv := Match{Name: name, Suffix: suffix, span: span}
 	if s[i] == check[suffix] {
 		i++
-		rv.longest = true
+		rv.Longest = true
 	}
 	end := skipToNext(s, "}", i)
-	rv.pattern = manglePattern(s[i:end])
+	rv.Pattern = manglePattern(s[i:end])
+
+	return rv
+}
+
+// Find the leftmost, longest substring of v that matches pattern.
+// Returns the start and end byte offsets of the match, and whether a
+// match was found at all.
+func findLeftmostMatch(v, pattern string) (int, int, bool) {
+	l := len(v)
+	for start := 0; start <= l; start++ {
+		for end := l; end >= start; end-- {
+			matched, err := filepath.Match(pattern, v[start:end])
+			if err == nil && matched {
+				return start, end, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// Find the longest prefix of v that matches pattern, returning its
+// end offset.
+func findAnchoredPrefix(v, pattern string) (int, bool) {
+	for end := len(v); end >= 0; end-- {
+		matched, err := filepath.Match(pattern, v[:end])
+		if err == nil && matched {
+			return end, true
+		}
+	}
+	return 0, false
+}
+
+// Find the longest suffix of v that matches pattern, returning its
+// start offset.
+func findAnchoredSuffix(v, pattern string) (int, bool) {
+	for start := 0; start <= len(v); start++ {
+		matched, err := filepath.Match(pattern, v[start:])
+		if err == nil && matched {
+			return start, true
+		}
+	}
+	return 0, false
+}
+
+// Substitute is a pattern substitution expansion, like
+// "${foo/pat/rep}", "${foo//pat/rep}" (replace every match),
+// "${foo/#pat/rep}" (anchored to the start of the value) and
+// "${foo/%pat/rep}" (anchored to the end of the value).
+type Substitute struct {
+	Name        string
+	Pattern     string
+	Replacement string
+	Global      bool
+	AnchorStart bool
+	AnchorEnd   bool
+
+	span Span
+}
+
+func (s Substitute) Pos() Span { return s.span }
+func (Substitute) node()       {}
+
+func (s Substitute) expand(e Environment) string {
+	v, ok := e.Get(s.Name)
+	if !ok {
+		return ""
+	}
+
+	switch {
+	case s.AnchorStart:
+		if end, ok := findAnchoredPrefix(v, s.Pattern); ok {
+			return s.Replacement + v[end:]
+		}
+		return v
+	case s.AnchorEnd:
+		if start, ok := findAnchoredSuffix(v, s.Pattern); ok {
+			return v[:start] + s.Replacement
+		}
+		return v
+	}
+
+	start, end, ok := findLeftmostMatch(v, s.Pattern)
+	if !ok {
+		return v
+	}
+	if !s.Global {
+		return v[:start] + s.Replacement + v[end:]
+	}
+
+	var acc strings.Builder
+	o := 0
+	for ok {
+		acc.WriteString(v[o : o+start])
+		acc.WriteString(s.Replacement)
+		o += end
+		if start == end {
+			if o >= len(v) {
+				break
+			}
+			acc.WriteByte(v[o])
+			o++
+		}
+		start, end, ok = findLeftmostMatch(v[o:], s.Pattern)
+	}
+	acc.WriteString(v[o:])
+
+	return acc.String()
+}
+
+func makeSubstitute(s string, i int, name string, span Span) (expansion, error) {
+	rv := Substitute{Name: name, span: span}
+
+	switch s[i] {
+	case '/':
+		rv.Global = true
+		i++
+	case '#':
+		rv.AnchorStart = true
+		i++
+	case '%':
+		rv.AnchorEnd = true
+		i++
+	}
+
+	sep := skipToNext(s, "/}", i)
+	if sep == -1 {
+		return rv, parseErr(s, i, "in substitution pattern", fmt.Errorf("unterminated substitution"))
+	}
+	rv.Pattern = manglePattern(s[i:sep])
+
+	if s[sep] == '/' {
+		end := skipToNext(s, "}", sep+1)
+		if end == -1 {
+			return rv, parseErr(s, sep+1, "in substitution replacement", fmt.Errorf("unterminated substitution"))
+		}
+		rv.Replacement = s[sep+1 : end]
+	}
+
+	return rv, nil
+}
+
+// CaseMod is a case modification expansion, like "${foo^}" (upcase
+// first character), "${foo^^}" (upcase every character), "${foo,}"
+// (downcase first character) and "${foo,,}" (downcase every
+// character).
+type CaseMod struct {
+	Name  string
+	Upper bool
+	All   bool
+
+	span Span
+}
+
+func (c CaseMod) Pos() Span { return c.span }
+func (CaseMod) node()       {}
+
+func (c CaseMod) expand(e Environment) string {
+	v, ok := e.Get(c.Name)
+	if !ok || v == "" {
+		return ""
+	}
+
+	if c.All {
+		if c.Upper {
+			return strings.ToUpper(v)
+		}
+		return strings.ToLower(v)
+	}
+
+	first := v[:1]
+	if c.Upper {
+		first = strings.ToUpper(first)
+	} else {
+		first = strings.ToLower(first)
+	}
+
+	return first + v[1:]
+}
+
+func makeCaseMod(s string, i int, name string, span Span) expansion {
+	c := s[i]
+	rv := CaseMod{Name: name, Upper: c == '^', span: span}
+
+	i++
+	if i < len(s) && s[i] == c {
+		rv.All = true
+	}
 
 	return rv
 }
 
+// NamesMatching is a variable-name listing expansion,
+// "${!prefix*}"/"${!prefix@}", which expands to the space-separated,
+// sorted list of variable names that start with Prefix.
+type NamesMatching struct {
+	Prefix string
+
+	span Span
+}
+
+func (n NamesMatching) Pos() Span { return n.span }
+func (NamesMatching) node()       {}
+
+func (n NamesMatching) expand(e Environment) string {
+	var matches []string
+	for _, name := range e.Names() {
+		if strings.HasPrefix(name, n.Prefix) {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+
+	return strings.Join(matches, " ")
+}
+
+// ParseError records where, and in what parsing state, an expansion
+// failed to parse. Offset is a byte offset into Input, and State is
+// a short description of what was being parsed (e.g. "in offset
+// spec"). Errors produced deeper in the parser are chained via Err,
+// so errors.Is/errors.As can reach the original cause.
+//
+// (*Expander).ExpandStream only ever parses one isolated
+// "$..."/"${...}" token at a time, so Input holds that token rather
+// than the whole source read from src; Offset is rebased to still
+// point at the right byte in the caller's original source.
+type ParseError struct {
+	Input  string
+	Offset int
+	State  string
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: offset %d: %v", e.State, e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// rebaseParseError walks err's Unwrap chain, shifting the Offset of
+// every *ParseError it finds by base. It's used by
+// (*Expander).ExpandStream to turn an offset into the isolated
+// token text handed to parseExpansion back into an offset into the
+// caller's actual source.
+func rebaseParseError(err error, base int64) error {
+	for e := err; e != nil; {
+		if pe, ok := e.(*ParseError); ok {
+			pe.Offset += int(base)
+		}
+		u, ok := e.(interface{ Unwrap() error })
+		if !ok {
+			break
+		}
+		e = u.Unwrap()
+	}
+	return err
+}
+
+// parseErr builds a ParseError for the given input and offset,
+// wrapping cause.
+func parseErr(s string, offset int, state string, cause error) error {
+	return &ParseError{Input: s, Offset: offset, State: state, Err: cause}
+}
+
 // Parse the correct type of expansion from a string at a given
 // offset, we expect the caller to already know where it ends, for
 // purposes of string slicing.
 func parseExpansion(s string, o int) (expansion, error) {
 	if s[o] != '$' {
-		return constant("failed"), fmt.Errorf("Unexpected first character, %c", s[o])
+		return Literal{Value: "failed"}, parseErr(s, o, "expecting variable sigil", fmt.Errorf("unexpected first character %q", s[o]))
 	}
 
+	span := Span{o, findNextEnd(s, o)}
+
 	switch {
 	case parameterConstituent(s[o+1]):
 		p, err := strconv.Atoi(s[o+1 : o+2])
 		if err != nil {
-			return constant("positional parse failed"), err
+			return Literal{Value: "positional parse failed"}, parseErr(s, o+1, "in positional parameter", err)
 		}
-		return positional(p), nil
+		return Positional{Index: p, span: span}, nil
 	case nameConstituent(s[o+1]):
 		p := o + 1
 		l := len(s)
 		for p < l && nameConstituent(s[p]) {
 			p++
 		}
-		return normal(s[o+1 : p]), nil
+		return Normal{Name: s[o+1 : p], span: span}, nil
+	case o+2 < len(s) && s[o+1] == '(' && s[o+2] == '(':
+		return parseArith(s, o)
 	case s[o+1] == '{':
 		for i := o + 2; i < len(s); i++ {
 			c := s[i]
 			switch c {
 			case '!':
 				if i == o+2 {
-					// We are looking at an indirect expansion
 					end := findNextEnd(s, i)
-					rv := indirect{name: s[i+1 : end]}
+					if end < len(s) && (s[end] == '*' || s[end] == '@') {
+						// We are looking at a variable-name listing
+						rv := NamesMatching{Prefix: s[i+1 : end], span: span}
+						return rv, nil
+					}
+					// We are looking at an indirect expansion
+					rv := Indirect{Name: s[i+1 : end], span: span}
 					return rv, nil
 				}
 			case '#':
 				if i == o+2 {
 					// We are looking at a length expansion
 					end := findNextEnd(s, i)
-					rv := length{name: s[i+1 : end]}
+					rv := Length{Name: s[i+1 : end], span: span}
 					return rv, nil
 				}
 				// Prefix match
-				return makeMatch(s, i+1, s[o+2:i], false), nil
+				return makeMatch(s, i+1, s[o+2:i], false, span), nil
 			case '%':
 				// Suffix match
-				return makeMatch(s, i+1, s[o+2:i], true), nil
+				return makeMatch(s, i+1, s[o+2:i], true, span), nil
+			case '/':
+				return makeSubstitute(s, i+1, s[o+2:i], span)
+			case '^', ',':
+				return makeCaseMod(s, i, s[o+2:i], span), nil
 			case ':':
 				switch {
 				case s[i+1] == '-':
-					return makeDefaulted(s, i+2, s[o+2:i], false)
+					return makeDefaulted(s, i+2, s[o+2:i], false, span)
 				case s[i+1] == '=':
-					return makeAssigned(s, i+2, s[o+2:i], false)
+					return makeAssigned(s, i+2, s[o+2:i], false, span)
 				case s[i+1] == '+':
-					return makeAlternated(s, i+2, s[o+2:i], false)
+					return makeAlternated(s, i+2, s[o+2:i], false, span)
 				}
-				return makeOffseted(s, i, s[o+2:i])
+				return makeOffseted(s, i, s[o+2:i], span)
 			case '-':
-				return makeDefaulted(s, i+1, s[o+2:i], true)
+				return makeDefaulted(s, i+1, s[o+2:i], true, span)
 			case '=':
-				return makeAssigned(s, i+1, s[o+2:i], true)
+				return makeAssigned(s, i+1, s[o+2:i], true, span)
 			case '+':
-				return makeAlternated(s, i+1, s[o+2:i], true)
+				return makeAlternated(s, i+1, s[o+2:i], true, span)
 			case '}':
-				return normal(s[o+2 : i]), nil
+				return Normal{Name: s[o+2 : i], span: span}, nil
 			}
 
 		}
 	}
-	return constant("failed"), fmt.Errorf("Expected to have been caught by a switch statement")
+	return Literal{Value: "failed"}, parseErr(s, o, "in brace expansion", fmt.Errorf("expected to have been caught by a switch statement"))
 }
 
-// Expand a string, with a given environment. Return the expanded
-// string and the first error encountered while expanding the string.
-func expand(s string, e Environment) (string, error) {
-	var parts []string
+// Template is a parsed sequence of literal and expansion nodes,
+// ready to be expanded (possibly more than once, and possibly
+// against different Environments) without re-parsing the source
+// text.
+type Template []Node
+
+// Parse parses s into a Template. Parsing never consults an
+// Environment: state-modifying expansions like "${foo:=default}"
+// only take effect once the Template is Expanded.
+func Parse(s string) (*Template, error) {
+	var nodes []Node
 	offset := 0
 	done := false
 
 	for !done {
 		next := findNextStart(s, offset)
 		if next == -1 {
-			parts = append(parts, s[offset:])
+			if offset < len(s) {
+				nodes = append(nodes, Literal{Value: s[offset:], span: Span{offset, len(s)}})
+			}
 			done = true
 			continue
 		}
 
-		parts = append(parts, s[offset:next])
-		exp, err := parseExpansion(s, next)
+		if next > offset {
+			nodes = append(nodes, Literal{Value: s[offset:next], span: Span{offset, next}})
+		}
+
+		node, err := parseExpansion(s, next)
 		if err != nil {
-			return "An error occurred", err
+			t := Template(nodes)
+			return &t, err
+		}
+
+		nodes = append(nodes, node)
+		offset = node.Pos().End
+	}
+
+	t := Template(nodes)
+	return &t, nil
+}
+
+// Expand walks every node in t, expanding it against e, and
+// concatenates the results. On error, the returned string holds
+// everything that was successfully expanded before the failure.
+func (t *Template) Expand(e Environment) (string, error) {
+	var parts []string
+
+	for _, n := range *t {
+		exp, ok := n.(expansion)
+		if !ok {
+			continue
 		}
-		offset = findNextEnd(s, next)
 		parts = append(parts, exp.expand(e))
 	}
 
 	return strings.Join(parts, ""), nil
 }
 
+// Walk visits every node of t in source order, depth first, calling
+// fn for each one. If fn returns false for a node, Walk does not
+// descend into that node's children. Defaulted, Assign and Alternate
+// are the only composite nodes; each has a single child, the Word
+// used in place of the named variable.
+func Walk(t *Template, fn func(Node) bool) {
+	for _, n := range *t {
+		walkNode(n, fn)
+	}
+}
+
+func walkNode(n Node, fn func(Node) bool) {
+	if !fn(n) {
+		return
+	}
+
+	switch v := n.(type) {
+	case Defaulted:
+		walkNode(v.Word, fn)
+	case Assign:
+		walkNode(v.Word, fn)
+	case Alternate:
+		walkNode(v.Word, fn)
+	}
+}
+
+// ErrExpansionDepthExceeded is returned by (*Expander).ExpandStream
+// when a "${...}" nests deeper than the Expander's
+// MaxExpansionDepth in the source text, e.g. "${a:-${b:-${c}}}".
+// Only the text is measured: "${!...}" resolves a single level of
+// indirection, so variable values never add to the depth.
+type ErrExpansionDepthExceeded struct {
+	Depth int
+}
+
+func (e *ErrExpansionDepthExceeded) Error() string {
+	return fmt.Sprintf("expansion nested more than %d levels deep", e.Depth)
+}
+
+// defaultMaxExpansionDepth is used whenever an Expander's
+// MaxExpansionDepth is left at its zero value.
+const defaultMaxExpansionDepth = 32
+
+// literalBatchSize bounds how much of a literal run ExpandStream
+// buffers before flushing it to dst, so a long stretch of plain
+// text without any "$"/"\\" is still streamed rather than held
+// entirely in memory.
+const literalBatchSize = 4096
+
+// Expander streams expansion of text read from an io.Reader to an
+// io.Writer, without holding the whole input in memory. The text of
+// an in-progress "${...}" expansion is buffered in full, and plain
+// literal runs are buffered only up to literalBatchSize before being
+// flushed to the destination.
+type Expander struct {
+	env Environment
+
+	// MaxExpansionDepth bounds how deeply "${...}" expansions may
+	// nest before ExpandStream gives up and returns an
+	// *ErrExpansionDepthExceeded. The zero value means
+	// defaultMaxExpansionDepth.
+	MaxExpansionDepth int
+}
+
+// NewExpander returns an Expander that resolves variables against
+// env.
+func NewExpander(env Environment) *Expander {
+	return &Expander{env: env, MaxExpansionDepth: defaultMaxExpansionDepth}
+}
+
+// ExpandStream reads src, copying literal text straight to dst and
+// substituting each "$..."/"${...}" it finds along the way. It
+// returns the number of bytes written to dst and the first error
+// encountered, which may be a *ParseError, an
+// *ErrExpansionDepthExceeded, or an error from src/dst themselves.
+// On error, everything written so far remains in dst.
+func (x *Expander) ExpandStream(dst io.Writer, src io.Reader) (int64, error) {
+	maxDepth := x.MaxExpansionDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxExpansionDepth
+	}
+
+	r := bufio.NewReader(src)
+	var written int64
+	var consumed int64
+	lit := make([]byte, 0, literalBatchSize)
+
+	// flush writes out any buffered literal run, tracking exactly
+	// how many bytes reached dst via the n returned from dst.Write.
+	flush := func() error {
+		if len(lit) == 0 {
+			return nil
+		}
+		n, werr := dst.Write(lit)
+		written += int64(n)
+		lit = lit[:0]
+		return werr
+	}
+
+	// bail flushes any buffered literal run before returning err, so
+	// a write failure during that flush isn't lost behind whatever
+	// read/parse error triggered the return.
+	bail := func(err error) (int64, error) {
+		if ferr := flush(); ferr != nil {
+			return written, ferr
+		}
+		return written, err
+	}
+
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return bail(nil)
+		}
+		if err != nil {
+			return bail(err)
+		}
+		consumed++
+
+		switch b {
+		case '\\':
+			if ferr := flush(); ferr != nil {
+				return written, ferr
+			}
+
+			n, werr := dst.Write([]byte{b})
+			written += int64(n)
+			if werr != nil {
+				return written, werr
+			}
+
+			nb, rerr := r.ReadByte()
+			if rerr == io.EOF {
+				return written, nil
+			}
+			if rerr != nil {
+				return written, rerr
+			}
+			consumed++
+
+			n, werr = dst.Write([]byte{nb})
+			written += int64(n)
+			if werr != nil {
+				return written, werr
+			}
+		case '$':
+			if ferr := flush(); ferr != nil {
+				return written, ferr
+			}
+			tokenStart := consumed - 1
+
+			buf, rerr := readExpansionToken(r, maxDepth)
+			if rerr != nil {
+				return written, rerr
+			}
+			consumed += int64(len(buf) - 1)
+
+			exp, perr := parseExpansion(buf, 0)
+			if perr != nil {
+				return written, rebaseParseError(perr, tokenStart)
+			}
+
+			n, werr := io.WriteString(dst, exp.expand(x.env))
+			written += int64(n)
+			if werr != nil {
+				return written, werr
+			}
+		default:
+			lit = append(lit, b)
+			if len(lit) >= literalBatchSize {
+				if ferr := flush(); ferr != nil {
+					return written, ferr
+				}
+			}
+		}
+	}
+}
+
+// readExpansionToken reads just enough of r, after a leading '$'
+// already consumed by the caller, to isolate one complete
+// "$name"/"$1"/"${...}" token, including any nested "${...}" it
+// contains. The returned string starts with '$' and is suitable for
+// passing straight to parseExpansion.
+func readExpansionToken(r *bufio.Reader, maxDepth int) (string, error) {
+	var buf strings.Builder
+	buf.WriteByte('$')
+
+	nb, err := r.ReadByte()
+	if err == io.EOF {
+		return buf.String(), nil
+	}
+	if err != nil {
+		return buf.String(), err
+	}
+
+	if nb == '(' {
+		nb2, err := r.ReadByte()
+		if err == io.EOF {
+			buf.WriteByte(nb)
+			return buf.String(), nil
+		}
+		if err != nil {
+			buf.WriteByte(nb)
+			return buf.String(), err
+		}
+		if nb2 != '(' {
+			buf.WriteByte(nb)
+			buf.WriteByte(nb2)
+			return buf.String(), nil
+		}
+
+		buf.WriteByte(nb)
+		buf.WriteByte(nb2)
+		depth := 2
+		for depth > 0 {
+			c, err := r.ReadByte()
+			if err == io.EOF {
+				return buf.String(), nil
+			}
+			if err != nil {
+				return buf.String(), err
+			}
+			buf.WriteByte(c)
+
+			switch c {
+			case '(':
+				depth++
+				if depth > maxDepth {
+					return buf.String(), &ErrExpansionDepthExceeded{Depth: maxDepth}
+				}
+			case ')':
+				depth--
+			}
+		}
+
+		return buf.String(), nil
+	}
+
+	if nb != '{' {
+		buf.WriteByte(nb)
+		if parameterConstituent(nb) {
+			return buf.String(), nil
+		}
+		for {
+			c, err := r.ReadByte()
+			if err == io.EOF {
+				return buf.String(), nil
+			}
+			if err != nil {
+				return buf.String(), err
+			}
+			if !nameConstituent(c) {
+				return buf.String(), r.UnreadByte()
+			}
+			buf.WriteByte(c)
+		}
+	}
+
+	buf.WriteByte('{')
+	depth := 1
+	for depth > 0 {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return buf.String(), nil
+		}
+		if err != nil {
+			return buf.String(), err
+		}
+		buf.WriteByte(c)
+
+		switch c {
+		case '{':
+			depth++
+			if depth > maxDepth {
+				return buf.String(), &ErrExpansionDepthExceeded{Depth: maxDepth}
+			}
+		case '}':
+			depth--
+		}
+	}
+
+	return buf.String(), nil
+}
+
 // Expand a string using the os Environment. Return the expanded
 // string and/or errors encountered during the parsing.
 func Expand(s string) (string, error) {
-	return expand(s, native{})
+	return ExpandWithEnvironment(s, native{})
 }
 
 // Expand a string using a passed-in environment. Return the expanded
-// string and/or erors encountered during the parsing.
+// string and/or erors encountered during the parsing. On error, the
+// returned string holds everything that was successfully expanded
+// before the failure.
 func ExpandWithEnvironment(s string, e Environment) (string, error) {
-	return expand(s, e)
+	var buf bytes.Buffer
+
+	_, err := NewExpander(e).ExpandStream(&buf, strings.NewReader(s))
+
+	return buf.String(), err
 }
@@ -1,6 +1,9 @@
 package env
 
 import (
+	"bytes"
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -62,32 +65,43 @@ func TestExpand(t *testing.T) {
 		d expansion
 		e string
 	}{
-		{indirect{"foo"}, "gazonk"},
-		{indirect{"bar"}, ""},
-		{normal("foo"), "bar"},
-		{normal("bar"), "gazonk"},
-		{defaulted{name: "foo", word: constant("blubb")}, "bar"},
-		{defaulted{"bar", constant("blubb"), false}, "gazonk"},
-		{defaulted{"slem", constant("blubb"), false}, "blubb"},
-		{defaulted{"slem", normal("bar"), false}, "gazonk"},
-		{defaulted{"bar", normal("foo"), false}, "gazonk"},
-		{defaulted{"empty", normal("foo"), false}, "bar"},
-		{defaulted{"empty", normal("foo"), true}, ""},
-		{offset{"bar", 0, 0, false}, "gazonk"},
-		{offset{"bar", 0, 2, false}, "gazonk"},
-		{offset{"bar", 0, -1, true}, "gazon"},
-		{offset{"bar", 0, -1, false}, "gazonk"},
-		{offset{"bar", -6, 11, true}, "gazonk"},
-		{offset{"bar", 0, 3, true}, "gaz"},
-		{offset{"bar", 2, 3, false}, "zonk"},
-		{offset{"bar", 2, 3, true}, "zon"},
-		{offset{"bar", 2, -3, true}, "z"},
-		{offset{"bar", 2, 4711, true}, "zonk"},
-		{alternate{"unset", constant("text"), false}, ""},
-		{alternate{"empty", constant("text"), true}, "text"},
-		{alternate{"empty", constant("text"), false}, ""},
-		{alternate{"foo", constant("text"), false}, "text"},
-		{alternate{"foo", constant("text"), true}, "text"},
+		{Indirect{Name: "foo"}, "gazonk"},
+		{Indirect{Name: "bar"}, ""},
+		{Normal{Name: "foo"}, "bar"},
+		{Normal{Name: "bar"}, "gazonk"},
+		{Defaulted{Name: "foo", Word: Literal{Value: "blubb"}}, "bar"},
+		{Defaulted{Name: "bar", Word: Literal{Value: "blubb"}}, "gazonk"},
+		{Defaulted{Name: "slem", Word: Literal{Value: "blubb"}}, "blubb"},
+		{Defaulted{Name: "slem", Word: Normal{Name: "bar"}}, "gazonk"},
+		{Defaulted{Name: "bar", Word: Normal{Name: "foo"}}, "gazonk"},
+		{Defaulted{Name: "empty", Word: Normal{Name: "foo"}}, "bar"},
+		{Defaulted{Name: "empty", Word: Normal{Name: "foo"}, Unset: true}, ""},
+		{Offset{Name: "bar", Start: 0}, "gazonk"},
+		{Offset{Name: "bar", Start: 0, Length: 2}, "gazonk"},
+		{Offset{Name: "bar", Start: 0, Length: -1, HasLength: true}, "gazon"},
+		{Offset{Name: "bar", Start: 0, Length: -1}, "gazonk"},
+		{Offset{Name: "bar", Start: -6, Length: 11, HasLength: true}, "gazonk"},
+		{Offset{Name: "bar", Start: 0, Length: 3, HasLength: true}, "gaz"},
+		{Offset{Name: "bar", Start: 2, Length: 3}, "zonk"},
+		{Offset{Name: "bar", Start: 2, Length: 3, HasLength: true}, "zon"},
+		{Offset{Name: "bar", Start: 2, Length: -3, HasLength: true}, "z"},
+		{Offset{Name: "bar", Start: 2, Length: 4711, HasLength: true}, "zonk"},
+		{Alternate{Name: "unset", Word: Literal{Value: "text"}}, ""},
+		{Alternate{Name: "empty", Word: Literal{Value: "text"}, Unset: true}, "text"},
+		{Alternate{Name: "empty", Word: Literal{Value: "text"}}, ""},
+		{Alternate{Name: "foo", Word: Literal{Value: "text"}}, "text"},
+		{Alternate{Name: "foo", Word: Literal{Value: "text"}, Unset: true}, "text"},
+		{Substitute{Name: "bar", Pattern: "z*k", Replacement: "X"}, "gaX"},
+		{Substitute{Name: "bar", Pattern: "z", Replacement: "X", Global: true}, "gaXonk"},
+		{Substitute{Name: "bar", Pattern: "gaz*", Replacement: "X", AnchorStart: true}, "X"},
+		{Substitute{Name: "bar", Pattern: "onk", Replacement: "X", AnchorEnd: true}, "gazX"},
+		{Substitute{Name: "bar", Pattern: "q", Replacement: "X"}, "gazonk"},
+		{CaseMod{Name: "foo", Upper: true}, "Bar"},
+		{CaseMod{Name: "foo", Upper: true, All: true}, "BAR"},
+		{CaseMod{Name: "bar"}, "gazonk"},
+		{CaseMod{Name: "bar", All: true}, "gazonk"},
+		{NamesMatching{Prefix: "ba"}, "bar"},
+		{NamesMatching{Prefix: "z"}, ""},
 	}
 
 	for ix, c := range cases {
@@ -131,6 +145,15 @@ func TestParseExpansion1(t *testing.T) {
 		{"${#foo}", "3"},
 		{"${#bar}", "6"},
 		{"${#empty}", "0"},
+		{"${bar/zon/XX}", "gaXXk"},
+		{"${bar//o/0}", "gaz0nk"},
+		{"${bar/#gaz/X}", "Xonk"},
+		{"${bar/%onk/X}", "gazX"},
+		{"${foo^}", "Bar"},
+		{"${foo^^}", "BAR"},
+		{"${foo,}", "bar"},
+		{"${bar,,}", "gazonk"},
+		{"${!ba*}", "bar"},
 	}
 
 	for ix, c := range cases {
@@ -142,6 +165,221 @@ func TestParseExpansion1(t *testing.T) {
 	}
 }
 
+func TestParseErrorOffsets(t *testing.T) {
+	cases := []struct {
+		in     string
+		state  string
+		offset int
+	}{
+		{"${foo:1x}", "in offset spec", 6},
+		{"${foo:1:1x}", "in length spec", 8},
+		{"${foo:-${bar:1x}}", "in default word", 7},
+	}
+
+	for ix, c := range cases {
+		_, err := parseExpansion(c.in, 0)
+		if err == nil {
+			t.Errorf("Case %d, (%s), expected an error, saw none", ix, c.in)
+			continue
+		}
+
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("Case %d, (%s), expected a *ParseError, saw %T", ix, c.in, err)
+			continue
+		}
+		if pe.State != c.state {
+			t.Errorf("Case %d, (%s), saw state %q, wanted %q", ix, c.in, pe.State, c.state)
+		}
+		if pe.Offset != c.offset {
+			t.Errorf("Case %d, (%s), saw offset %d, wanted %d", ix, c.in, pe.Offset, c.offset)
+		}
+		if pe.Unwrap() == nil {
+			t.Errorf("Case %d, (%s), expected Unwrap() to return the underlying cause", ix, c.in)
+		}
+	}
+}
+
+func TestExpandWithEnvironmentErrorOffset(t *testing.T) {
+	e := internal{"foo": "bar"}
+
+	_, err := ExpandWithEnvironment("0123456789${foo:1x}", e)
+	if err == nil {
+		t.Fatal("expected an error, saw none")
+	}
+
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected a *ParseError, saw %T", err)
+	}
+	if pe.Offset != 16 {
+		t.Errorf("saw offset %d, wanted 16 (into the caller's source, not the isolated token)", pe.Offset)
+	}
+}
+
+func TestParseAndTemplate(t *testing.T) {
+	e := internal{"foo": "bar"}
+
+	tpl, err := Parse("a${foo}b${missing:-c}")
+	if err != nil {
+		t.Fatalf("unexpected error, %s", err)
+	}
+
+	seen, err := tpl.Expand(e)
+	if err != nil {
+		t.Fatalf("unexpected error, %s", err)
+	}
+	if seen != "abarbc" {
+		t.Errorf("saw «%s», wanted «abarbc»", seen)
+	}
+
+	// Expanding again must produce the same result, and must not
+	// require re-parsing.
+	seen, err = tpl.Expand(e)
+	if err != nil || seen != "abarbc" {
+		t.Errorf("second Expand saw «%s», %v", seen, err)
+	}
+}
+
+func TestParseAndTemplateNested(t *testing.T) {
+	e := internal{"a": "B", "c": "D"}
+
+	tpl, err := Parse("${a:-${b}} ${c:-${d}}")
+	if err != nil {
+		t.Fatalf("unexpected error, %s", err)
+	}
+
+	seen, err := tpl.Expand(e)
+	if err != nil {
+		t.Fatalf("unexpected error, %s", err)
+	}
+	if seen != "B D" {
+		t.Errorf("saw «%s», wanted «B D»", seen)
+	}
+}
+
+func TestParseAndTemplateArith(t *testing.T) {
+	e := internal{}
+
+	tpl, err := Parse("a$((1+2))b")
+	if err != nil {
+		t.Fatalf("unexpected error, %s", err)
+	}
+
+	seen, err := tpl.Expand(e)
+	if err != nil {
+		t.Fatalf("unexpected error, %s", err)
+	}
+	if seen != "a3b" {
+		t.Errorf("saw «%s», wanted «a3b»", seen)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	tpl, err := Parse("a${foo:-${bar}}b")
+	if err != nil {
+		t.Fatalf("unexpected error, %s", err)
+	}
+
+	var names []string
+	Walk(tpl, func(n Node) bool {
+		switch v := n.(type) {
+		case Normal:
+			names = append(names, v.Name)
+		case Defaulted:
+			names = append(names, v.Name)
+		}
+		return true
+	})
+
+	want := []string{"foo", "bar"}
+	if len(names) != len(want) {
+		t.Fatalf("saw %v, wanted %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("saw %v, wanted %v", names, want)
+			break
+		}
+	}
+}
+
+func TestExpandStream(t *testing.T) {
+	e := internal{"foo": "bar"}
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"a${foo}b", "abarb"},
+		{"a${missing:-${foo}}b", "abarb"},
+		{`a\$foo`, `a\$foo`},
+	}
+
+	for ix, c := range cases {
+		var out bytes.Buffer
+		n, err := NewExpander(e).ExpandStream(&out, strings.NewReader(c.in))
+		if err != nil {
+			t.Errorf("Case %d, (%s), unexpected error, %s", ix, c.in, err)
+			continue
+		}
+		if out.String() != c.want {
+			t.Errorf("Case %d, (%s), saw «%s», wanted «%s»", ix, c.in, out.String(), c.want)
+		}
+		if n != int64(out.Len()) {
+			t.Errorf("Case %d, (%s), reported %d bytes written, buffer has %d", ix, c.in, n, out.Len())
+		}
+	}
+}
+
+// countingWriter counts how many times Write is called, to check
+// that literal runs are batched rather than written byte by byte.
+type countingWriter struct {
+	bytes.Buffer
+	calls int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.calls++
+	return w.Buffer.Write(p)
+}
+
+func TestExpandStreamBatchesLiteralRuns(t *testing.T) {
+	e := internal{"foo": "bar"}
+
+	in := strings.Repeat("x", 10000) + "${foo}"
+	var out countingWriter
+
+	_, err := NewExpander(e).ExpandStream(&out, strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("unexpected error, %s", err)
+	}
+	// The literal run is flushed in literalBatchSize-sized chunks
+	// rather than all at once, so ExpandStream doesn't have to hold
+	// an arbitrarily long run entirely in memory; it should still be
+	// far fewer calls than one per byte.
+	if want := 10000/literalBatchSize + 3; out.calls > want {
+		t.Errorf("literal run of 10000 bytes plus one expansion took %d Write calls, wanted at most %d", out.calls, want)
+	}
+}
+
+func TestExpandStreamDepthExceeded(t *testing.T) {
+	e := internal{"foo": "bar"}
+	x := NewExpander(e)
+	x.MaxExpansionDepth = 2
+
+	var out bytes.Buffer
+	_, err := x.ExpandStream(&out, strings.NewReader("${a:-${b:-${c:-${d}}}}"))
+	if err == nil {
+		t.Fatal("expected an error, saw none")
+	}
+
+	var depthErr *ErrExpansionDepthExceeded
+	if !errors.As(err, &depthErr) {
+		t.Errorf("expected *ErrExpansionDepthExceeded, saw %T (%s)", err, err)
+	}
+}
+
 func TestMainExpand(t *testing.T) {
 	e := internal{"foo": "bar", "bar": "gazonk", "empty": ""}
 
@@ -154,7 +392,7 @@ func TestMainExpand(t *testing.T) {
 	}
 
 	for ix, c := range cases {
-		seen, err := expand(c.in, e)
+		seen, err := ExpandWithEnvironment(c.in, e)
 		if err != nil && !c.err {
 			t.Errorf("Case %d, unexpected error, %s", ix, err)
 		}